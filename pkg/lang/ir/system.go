@@ -22,7 +22,9 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/errors"
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
@@ -31,6 +33,54 @@ import (
 	"github.com/tensorchord/envd/pkg/version"
 )
 
+// archSuffix returns the image tag suffix used by base images that do not
+// publish a multi-arch manifest list and instead ship one tag per
+// architecture (e.g. the r-base image).
+func archSuffix(platform *specs.Platform) string {
+	if platform == nil || platform.Architecture == "amd64" {
+		return ""
+	}
+	return "-" + platform.Architecture
+}
+
+// platformOpt returns the llb.ConstraintsOpt to pin a state to g.Platform,
+// falling back to the host's default platform when none was requested.
+//
+// A Graph only ever carries a single target platform: for a `--platform`
+// flag with more than one value, the caller builds one Graph per requested
+// platform and is responsible for combining the resulting solve results
+// into a multi-arch manifest list - that fan-out/assembly does not belong
+// in this package.
+func (g Graph) platformOpt() llb.ConstraintsOpt {
+	if g.Platform == nil {
+		return llb.Platform(platforms.DefaultSpec())
+	}
+	return llb.Platform(*g.Platform)
+}
+
+// sudoPrefix returns "sudo " when the build is running as a non-root user
+// against a base image that has sudo, and "" when it is already running as
+// root or g.HasSudo has been explicitly set to false.
+//
+// Whether sudo is available can only be known by probing the base image,
+// and that probe has to run, and resolve to a concrete bool, before this
+// Graph is compiled - a shell-level `command -v sudo` guard embedded in the
+// generated command cannot also decide which Linux user the llb.Exec runs
+// as, so it cannot stand in for the frontend doing that probe. Until the
+// frontend wires up that detection, g.HasSudo left nil is treated the same
+// as true: existing base images are assumed to have sudo, matching
+// pre-rootless-mode behavior. Pass HasSudo=false explicitly to opt in to
+// the rootless path on a sudo-less image.
+func (g Graph) sudoPrefix() string {
+	if g.uid == 0 {
+		return ""
+	}
+	if g.HasSudo != nil && !*g.HasSudo {
+		return ""
+	}
+	return "sudo "
+}
+
 func (g Graph) compileUbuntuAPT(root llb.State) llb.State {
 	if g.UbuntuAPTSource != nil {
 		logrus.WithField("source", *g.UbuntuAPTSource).Debug("using custom APT source")
@@ -45,6 +95,77 @@ func (g Graph) compileUbuntuAPT(root llb.State) llb.State {
 	return root
 }
 
+const (
+	condaRCFilePath = "/home/envd/.condarc"
+	pipConfFilePath = "/home/envd/.pip/pip.conf"
+)
+
+// compileCondaChannel writes ~/.condarc when g.CondaChannel has been set.
+//
+// g.CondaChannel itself is only populated programmatically today - the
+// Starlark builtins (`config.conda_channel(...)`) that would let a
+// build.envd set it still need to be added to the frontend package.
+func (g Graph) compileCondaChannel(root llb.State) llb.State {
+	if g.CondaChannel == nil {
+		return root
+	}
+	logrus.WithField("channel", g.CondaChannel.Channel).Debug("using custom conda channel")
+
+	var sb strings.Builder
+	sb.WriteString("channels:\n")
+	if g.CondaChannel.UseDefault {
+		sb.WriteString("  - defaults\n")
+	}
+	sb.WriteString(fmt.Sprintf("  - %s\n", g.CondaChannel.Channel))
+	sb.WriteString("default_channels:\n")
+	sb.WriteString(fmt.Sprintf("  - %s\n", g.CondaChannel.Channel))
+	sb.WriteString("show_channel_urls: true\n")
+
+	condarc := llb.Scratch().
+		File(llb.Mkdir(filepath.Dir(condaRCFilePath), 0755, llb.WithParents(true),
+			llb.WithUIDGID(g.uid, g.gid)),
+			llb.WithCustomName("[internal] setting conda channel")).
+		File(llb.Mkfile(condaRCFilePath, 0644, []byte(sb.String()),
+			llb.WithUIDGID(g.uid, g.gid)),
+			llb.WithCustomName("[internal] setting conda channel"))
+	return llb.Merge([]llb.State{root, condarc},
+		llb.WithCustomName("[internal] setting conda channel"))
+}
+
+// compilePyPIIndex writes ~/.pip/pip.conf when g.PyPIIndex has been set.
+//
+// g.PyPIIndex itself is only populated programmatically today - the
+// Starlark builtin (`config.pip_index(...)`) that would let a build.envd
+// set it still needs to be added to the frontend package.
+func (g Graph) compilePyPIIndex(root llb.State) llb.State {
+	if g.PyPIIndex == nil {
+		return root
+	}
+	logrus.WithField("index", g.PyPIIndex.IndexURL).Debug("using custom PyPI index")
+
+	var sb strings.Builder
+	sb.WriteString("[global]\n")
+	sb.WriteString(fmt.Sprintf("index-url = %s\n", g.PyPIIndex.IndexURL))
+	if len(g.PyPIIndex.ExtraIndexURL) > 0 {
+		sb.WriteString(fmt.Sprintf("extra-index-url = %s\n",
+			strings.Join(g.PyPIIndex.ExtraIndexURL, " ")))
+	}
+	if len(g.PyPIIndex.TrustedHost) > 0 {
+		sb.WriteString(fmt.Sprintf("trusted-host = %s\n",
+			strings.Join(g.PyPIIndex.TrustedHost, " ")))
+	}
+
+	pipConf := llb.Scratch().
+		File(llb.Mkdir(filepath.Dir(pipConfFilePath), 0755, llb.WithParents(true),
+			llb.WithUIDGID(g.uid, g.gid)),
+			llb.WithCustomName("[internal] setting pip index")).
+		File(llb.Mkfile(pipConfFilePath, 0644, []byte(sb.String()),
+			llb.WithUIDGID(g.uid, g.gid)),
+			llb.WithCustomName("[internal] setting pip index"))
+	return llb.Merge([]llb.State{root, pipConf},
+		llb.WithCustomName("[internal] setting pip index"))
+}
+
 func (g Graph) compileRun(root llb.State) llb.State {
 	if len(g.Exec) == 0 {
 		return root
@@ -77,12 +198,18 @@ func (g Graph) compileCopy(root llb.State) llb.State {
 	return result
 }
 
-func (g *Graph) compileCUDAPackages() llb.State {
+func (g *Graph) compileCUDAPackages() (llb.State, error) {
+	if g.Platform != nil && g.Platform.Architecture != "amd64" {
+		return llb.State{}, errors.Newf(
+			"CUDA is not supported on platform %s, only linux/amd64 images are published",
+			platforms.Format(*g.Platform))
+	}
 	root := llb.Image(fmt.Sprintf(
 		"docker.io/%s/python:3.9-%s-cuda%s-cudnn%s-envd-%s",
 		viper.GetString(flag.FlagDockerOrganization),
-		g.OS, *g.CUDA, *g.CUDNN, version.GetGitTagFromVersion()))
-	return root
+		g.OS, *g.CUDA, *g.CUDNN, version.GetGitTagFromVersion()),
+		g.platformOpt())
+	return root, nil
 }
 
 func (g Graph) compileSystemPackages(root llb.State) llb.State {
@@ -91,8 +218,9 @@ func (g Graph) compileSystemPackages(root llb.State) llb.State {
 	}
 
 	// Compose the package install command.
+	sudo := g.sudoPrefix()
 	var sb strings.Builder
-	sb.WriteString("sudo apt-get update && sudo apt-get install -y --no-install-recommends")
+	sb.WriteString(fmt.Sprintf("%sapt-get update && %sapt-get install -y --no-install-recommends", sudo, sudo))
 
 	for _, pkg := range g.SystemPackages {
 		sb.WriteString(fmt.Sprintf(" %s", pkg))
@@ -101,14 +229,37 @@ func (g Graph) compileSystemPackages(root llb.State) llb.State {
 	cacheDir := "/var/cache/apt"
 	cacheLibDir := "/var/lib/apt"
 
-	run := root.Run(llb.Shlex(fmt.Sprintf("bash -c \"%s\"", sb.String())),
+	if !g.KeepPackageCache {
+		// cacheDir and cacheLibDir are mounted below as persistent cache
+		// dirs, so their contents never land in the committed layer anyway
+		// - cleaning them here would only evict the shared apt cache and
+		// force every build to re-fetch package lists. Only sweep the
+		// paths that actually end up in the image layer.
+		sb.WriteString(fmt.Sprintf(" && %srm -rf /tmp/* /var/tmp/*", sudo))
+	}
+
+	escalate := g.HasSudo != nil && !*g.HasSudo && g.uid != 0
+	opts := []llb.RunOption{
+		llb.Shlex(fmt.Sprintf("bash -c \"%s\"", sb.String())),
 		llb.WithCustomNamef("apt-get install %s",
-			strings.Join(g.SystemPackages, " ")))
+			strings.Join(g.SystemPackages, " ")),
+	}
+	if escalate {
+		// No sudo available on the base image: escalate to root for the
+		// install itself, then switch back to envd below so later stages
+		// in the pipeline don't keep running as root.
+		opts = append(opts, llb.User("root"))
+	}
+	run := root.Run(opts...)
 	run.AddMount(cacheDir, llb.Scratch(),
 		llb.AsPersistentCacheDir(g.CacheID(cacheDir), llb.CacheMountShared))
 	run.AddMount(cacheLibDir, llb.Scratch(),
 		llb.AsPersistentCacheDir(g.CacheID(cacheLibDir), llb.CacheMountShared))
-	return run.Root()
+	result := run.Root()
+	if escalate {
+		result = llb.User("envd")(result)
+	}
+	return result
 }
 
 func (g *Graph) compileBase() (llb.State, error) {
@@ -125,13 +276,14 @@ func (g *Graph) compileBase() (llb.State, error) {
 	// Do not update user permission in the base image.
 	if g.Image != nil {
 		logger.WithField("image", *g.Image).Debugf("using custom base image")
-		return llb.Image(*g.Image), nil
+		return llb.Image(*g.Image, g.platformOpt()), nil
 	} else if g.CUDA == nil && g.CUDNN == nil {
 		switch g.Language.Name {
 		case "r":
-			base = llb.Image(fmt.Sprintf("docker.io/%s/r-base:4.2-envd-%s",
+			base = llb.Image(fmt.Sprintf("docker.io/%s/r-base:4.2-envd-%s%s",
 				viper.GetString(flag.FlagDockerOrganization),
-				version.GetGitTagFromVersion()))
+				version.GetGitTagFromVersion(), archSuffix(g.Platform)),
+				g.platformOpt())
 			// r-base image already has GID 1000.
 			// It is a trick, we actually use GID 1000
 			if g.gid == 1000 {
@@ -144,15 +296,21 @@ func (g *Graph) compileBase() (llb.State, error) {
 			base = llb.Image(fmt.Sprintf(
 				"docker.io/%s/python:3.9-ubuntu20.04-envd-%s",
 				viper.GetString(flag.FlagDockerOrganization),
-				version.GetGitTagFromVersion()))
+				version.GetGitTagFromVersion()),
+				g.platformOpt())
 		case "julia":
 			base = llb.Image(fmt.Sprintf(
 				"docker.io/%s/julia:1.8rc1-ubuntu20.04-envd-%s",
 				viper.GetString(flag.FlagDockerOrganization),
-				version.GetGitTagFromVersion()))
+				version.GetGitTagFromVersion()),
+				g.platformOpt())
 		}
 	} else {
-		base = g.compileCUDAPackages()
+		var err error
+		base, err = g.compileCUDAPackages()
+		if err != nil {
+			return llb.State{}, err
+		}
 	}
 	var res llb.ExecState
 
@@ -184,15 +342,37 @@ func (g *Graph) compileBase() (llb.State, error) {
 			Run(llb.Shlex(fmt.Sprintf("groupadd -g %d envd", g.gid)),
 				llb.WithCustomName("[internal] create user group envd")).
 			Run(llb.Shlex(fmt.Sprintf("useradd -p \"\" -u %d -g envd -s /bin/sh -m envd", g.uid)),
-				llb.WithCustomName("[internal] create user envd")).
-			Run(llb.Shlex("adduser envd sudo"),
-				llb.WithCustomName("[internal] add user envd to sudoers")).
+				llb.WithCustomName("[internal] create user envd"))
+		if g.HasSudo == nil || *g.HasSudo {
+			res = res.Run(llb.Shlex("adduser envd sudo"),
+				llb.WithCustomName("[internal] add user envd to sudoers"))
+		}
+		res = res.
 			Run(llb.Shlex("chown -R envd:envd /usr/local/lib"),
 				llb.WithCustomName("[internal] configure user permissions")).
 			Run(llb.Shlex("chown -R envd:envd /opt/conda"),
 				llb.WithCustomName("[internal] configure user permissions"))
 	}
-	return llb.User("envd")(res.Root()), nil
+
+	// Drop the conda/pip package caches unless the user opted to keep them,
+	// mirroring the KeepPackageCache gate used for apt. pip only ships in
+	// the conda env for the python language, so only purge it there.
+	if !g.KeepPackageCache {
+		cleanup := "conda clean -afy"
+		if g.Language.Name == "python" {
+			cleanup += " && pip cache purge"
+		}
+		res = res.Run(llb.Shlex(fmt.Sprintf("bash -c \"%s\"", cleanup)),
+			llb.WithCustomName("[internal] purge conda/pip cache"))
+	}
+
+	// Apply the conda/pip mirror config once the envd user and its home
+	// directory exist, so ~/.condarc and ~/.pip/pip.conf land in the right
+	// place, and before any later stage installs conda/pip packages.
+	home := res.Root()
+	home = g.compileCondaChannel(home)
+	home = g.compilePyPIIndex(home)
+	return llb.User("envd")(home), nil
 }
 
 func (g Graph) copySSHKey(root llb.State) (llb.State, error) {